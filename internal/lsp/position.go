@@ -10,29 +10,66 @@ import (
 	"fmt"
 	"go/token"
 	"net/url"
-	"os"
 	"unicode/utf8"
 
 	"golang.org/x/tools/internal/lsp/cache"
 	"golang.org/x/tools/internal/lsp/protocol"
 	"golang.org/x/tools/internal/lsp/source"
+	"golang.org/x/tools/internal/telemetry/event"
 )
 
 // fromProtocolURI converts a protocol.DocumentURI to a source.URI.
-// TODO(rstambler): Add logic here to support Windows.
-func fromProtocolURI(uri protocol.DocumentURI) (source.URI, error) {
-	unescaped, err := url.PathUnescape(string(uri))
+//
+// It parses the URI properly rather than unescaping the raw string, so that
+// it correctly handles a Windows drive letter (e.g.
+// "file:///c%3A/Users/foo/bar.go") and a UNC host
+// (e.g. "file://server/share/foo.go", from \\server\share\foo.go) rather
+// than silently dropping it. The resulting source.URI is re-canonicalized
+// through source.ToURI so it always round-trips through source.URI.Filename.
+func fromProtocolURI(ctx context.Context, uri protocol.DocumentURI) (source.URI, error) {
+	u, err := url.Parse(string(uri))
 	if err != nil {
 		return "", err
 	}
-	return source.URI(unescaped), nil
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("only file URIs are supported, got %q", u.Scheme)
+	}
+	path := u.Path
+	if u.Host != "" {
+		// UNC path, e.g. file://server/share/foo.go.
+		path = "//" + u.Host + path
+	}
+	result := source.ToURI(path)
+	if traceEnabled(false) {
+		const msg = "uri translated"
+		event.Log(ctx, msg, event.Label("uri", uri), event.Label("path", result.Filename()))
+		notifyTrace(ctx, msg)
+	}
+	return result, nil
 }
 
+// PositionEncoding identifies the unit protocol.Position.Character is
+// expressed in, as negotiated with the client via the
+// general.positionEncodings initialize capability. The LSP spec mandates
+// utf-16 when a client does not advertise a preference.
+type PositionEncoding int
+
+const (
+	// UTF16PositionEncoding counts columns in UTF-16 code units. This is
+	// the default required by the LSP spec.
+	UTF16PositionEncoding PositionEncoding = iota
+	// UTF8PositionEncoding counts columns in bytes, avoiding any
+	// transcoding cost for clients that advertise support for it.
+	UTF8PositionEncoding
+	// UTF32PositionEncoding counts columns in Unicode code points.
+	UTF32PositionEncoding
+)
+
 // fromProtocolLocation converts from a protocol location to a source range.
 // It will return an error if the file of the location was not valid.
 // It uses fromProtocolRange to convert the start and end positions.
-func fromProtocolLocation(ctx context.Context, v *cache.View, loc protocol.Location) (source.Range, error) {
-	sourceURI, err := fromProtocolURI(loc.URI)
+func fromProtocolLocation(ctx context.Context, v *cache.View, encoding PositionEncoding, loc protocol.Location) (source.Range, error) {
+	sourceURI, err := fromProtocolURI(ctx, loc.URI)
 	if err != nil {
 		return source.Range{}, err
 	}
@@ -40,24 +77,30 @@ func fromProtocolLocation(ctx context.Context, v *cache.View, loc protocol.Locat
 	if err != nil {
 		return source.Range{}, err
 	}
-	return fromProtocolRange(f, loc.Range), nil
+	return fromProtocolRange(ctx, f, encoding, loc.Range), nil
 }
 
 // toProtocolLocation converts from a source range back to a protocol location.
-func toProtocolLocation(fset *token.FileSet, r source.Range) protocol.Location {
+func toProtocolLocation(ctx context.Context, fset *token.FileSet, content []byte, encoding PositionEncoding, r source.Range) protocol.Location {
 	tok := fset.File(r.Start)
 	uri := source.ToURI(tok.Name())
-	return protocol.Location{
+	loc := protocol.Location{
 		URI:   protocol.DocumentURI(uri),
-		Range: toProtocolRange(tok, r),
+		Range: toProtocolRange(ctx, tok, content, encoding, r),
+	}
+	if traceEnabled(false) {
+		const msg = "range translated"
+		event.Log(ctx, msg, event.Label("span", r), event.Label("location", loc))
+		notifyTrace(ctx, msg)
 	}
+	return loc
 }
 
 // fromProtocolRange converts a protocol range to a source range.
 // It uses fromProtocolPosition to convert the start and end positions, which
 // requires the token file the positions belongs to.
-func fromProtocolRange(f source.File, r protocol.Range) source.Range {
-	start := fromProtocolPosition(f, r.Start)
+func fromProtocolRange(ctx context.Context, f source.File, encoding PositionEncoding, r protocol.Range) source.Range {
+	start := fromProtocolPosition(ctx, f, encoding, r.Start)
 	var end token.Pos
 	switch {
 	case r.End == r.Start:
@@ -65,7 +108,7 @@ func fromProtocolRange(f source.File, r protocol.Range) source.Range {
 	case r.End.Line < 0:
 		end = token.NoPos
 	default:
-		end = fromProtocolPosition(f, r.End)
+		end = fromProtocolPosition(ctx, f, encoding, r.End)
 	}
 	return source.Range{
 		Start: start,
@@ -74,93 +117,162 @@ func fromProtocolRange(f source.File, r protocol.Range) source.Range {
 }
 
 // toProtocolRange converts from a source range back to a protocol range.
-func toProtocolRange(f *token.File, r source.Range) protocol.Range {
+func toProtocolRange(ctx context.Context, f *token.File, content []byte, encoding PositionEncoding, r source.Range) protocol.Range {
 	return protocol.Range{
-		Start: toProtocolPosition(f, r.Start),
-		End:   toProtocolPosition(f, r.End),
+		Start: toProtocolPosition(ctx, f, content, encoding, r.Start),
+		End:   toProtocolPosition(ctx, f, content, encoding, r.End),
 	}
 }
 
-func debugmsg(v interface{}) {
-	f, err := os.OpenFile("c:/temp/debug-go.log", os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	defer f.Close()
-
-	fmt.Fprintf(f, "---\n%v\n", v)
-}
-
-func columnOffset(content []byte, pos protocol.Position) int {
-	var line, char, offset int
-
-	line = int(pos.Line)
-	for len(content) > 0 {
-		if line == 0 {
-			break
-		}
+// lineContent returns the bytes of the given 1-based line of content,
+// excluding the trailing newline, or nil if content has fewer lines.
+func lineContent(content []byte, line int) []byte {
+	for line > 1 {
 		i := bytes.IndexByte(content, '\n')
 		if i < 0 {
-			return -1
+			return nil
 		}
 		content = content[i+1:]
 		line--
 	}
+	if i := bytes.IndexByte(content, '\n'); i != -1 {
+		content = content[:i]
+	}
+	return content
+}
 
-	i := bytes.IndexByte(content, '\n')
-	if i != -1 {
-		content = content[:i+1]
+// columnOffset returns the byte offset, within the line identified by
+// pos.Line, of the column pos.Character, which per the LSP spec is a count
+// of UTF-16 code units (a rune outside the BMP, such as most emoji, counts
+// as 2). If pos.Character is beyond the end of the line, the line's length
+// is returned.
+func columnOffset(content []byte, pos protocol.Position) int {
+	line := lineContent(content, int(pos.Line)+1)
+	if line == nil {
+		return -1
 	}
+	return runeOffset(line, UTF16PositionEncoding, int(pos.Character))
+}
 
-	for len(content) > 0 {
-		char++
-		r, size := utf8.DecodeRune(content)
-		if r >= 0x10000 {
-			char++
-		}
-		if char > int(pos.Character) {
-			return offset
+// runeOffset returns the byte offset into line of the count-th column, where
+// columns are measured in units of encoding. If count is beyond the end of
+// line, len(line) is returned.
+func runeOffset(line []byte, encoding PositionEncoding, count int) int {
+	var units, offset int
+	for units < count && len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		switch encoding {
+		case UTF8PositionEncoding:
+			units += size
+		case UTF32PositionEncoding:
+			units++
+		default: // UTF16PositionEncoding
+			if r >= 0x10000 {
+				units += 2
+			} else {
+				units++
+			}
 		}
 		offset += size
-		content = content[size:]
+		line = line[size:]
 	}
+	return offset
+}
 
-	return -1
+// utf16Column returns the 0-based UTF-16 code-unit column of the byte
+// offset byteOffset within line.
+func utf16Column(line []byte, byteOffset int) int {
+	if byteOffset > len(line) {
+		byteOffset = len(line)
+	}
+	line = line[:byteOffset]
+	var units int
+	for len(line) > 0 {
+		r, size := utf8.DecodeRune(line)
+		if r >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+		line = line[size:]
+	}
+	return units
 }
 
 // fromProtocolPosition converts a protocol position (0-based line and column
 // number) to a token.Pos (byte offset value).
 // It requires the token file the pos belongs to in order to do this.
-func fromProtocolPosition(f source.File, pos protocol.Position) token.Pos {
-	line := lineStart(f, int(pos.Line)+1)
-	return line + token.Pos(columnOffset(f.GetContent(), pos)) // TODO: this is wrong, bytes not characters
+//
+// The LSP position is always expressed in terms of the on-disk file the
+// editor has open, so this deliberately ignores any //line directives: it
+// walks lineStart (which itself works in on-disk terms) rather than the
+// directive-adjusted positions that f.GetToken().Position would report.
+// encoding selects the unit pos.Character is expressed in, as negotiated
+// with the client; clients that don't advertise a preference get utf-16,
+// per the LSP spec.
+func fromProtocolPosition(ctx context.Context, f source.File, encoding PositionEncoding, pos protocol.Position) token.Pos {
+	line := lineStart(ctx, f, int(pos.Line)+1)
+	content := lineContent(f.GetContent(), int(pos.Line)+1)
+	result := line + token.Pos(runeOffset(content, encoding, int(pos.Character)))
+	if traceEnabled(true) {
+		const msg = "position translated"
+		event.Log(ctx, msg, event.Label("position", pos), event.Label("pos", result))
+		notifyTrace(ctx, msg)
+	}
+	return result
 }
 
 // toProtocolPosition converts from a token pos (byte offset) to a protocol
 // position  (0-based line and column number)
-// It requires the token file the pos belongs to in order to do this.
-func toProtocolPosition(f *token.File, pos token.Pos) protocol.Position {
+// It requires the token file the pos belongs to, and the file's content, in
+// order to do this.
+//
+// It uses PositionFor with adjusted=false so that a //line directive
+// present in the file (common in generated code, cgo, or goyacc/stringer
+// output) does not redirect the result onto the directive-declared file;
+// the LSP client only ever knows about the on-disk file it opened.
+// encoding selects the unit the returned Character is expressed in.
+func toProtocolPosition(ctx context.Context, f *token.File, content []byte, encoding PositionEncoding, pos token.Pos) protocol.Position {
 	if !pos.IsValid() {
 		return protocol.Position{Line: -1.0, Character: -1.0}
 	}
-	p := f.Position(pos)
-	return protocol.Position{
+	p := f.PositionFor(pos, false)
+	line := lineContent(content, p.Line)
+	var char int
+	switch encoding {
+	case UTF8PositionEncoding:
+		char = p.Column - 1
+	case UTF32PositionEncoding:
+		byteOffset := p.Column - 1
+		if byteOffset > len(line) {
+			byteOffset = len(line)
+		}
+		char = utf8.RuneCount(line[:byteOffset])
+	default: // UTF16PositionEncoding
+		char = utf16Column(line, p.Column-1)
+	}
+	result := protocol.Position{
 		Line:      float64(p.Line - 1),
-		Character: float64(p.Column - 1),
+		Character: float64(char),
+	}
+	if traceEnabled(true) {
+		const msg = "utf-16 column computed"
+		event.Log(ctx, msg, event.Label("pos", pos), event.Label("position", result))
+		notifyTrace(ctx, msg)
 	}
+	return result
 }
 
 // fromTokenPosition converts a token.Position (1-based line and column
 // number) to a token.Pos (byte offset value).
 // It requires the token file the pos belongs to in order to do this.
-func fromTokenPosition(f source.File, pos token.Position) token.Pos {
-	line := lineStart(f, pos.Line)
+func fromTokenPosition(ctx context.Context, f source.File, pos token.Position) token.Pos {
+	line := lineStart(ctx, f, pos.Line)
 	return line + token.Pos(pos.Column-1) // TODO: this is wrong, bytes not characters
 }
 
 // this functionality was borrowed from the analysisutil package
-func lineStart(f source.File, line int) token.Pos {
+func lineStart(ctx context.Context, f source.File, line int) token.Pos {
 	// Use binary search to find the start offset of this line.
 	//
 	// TODO(rstambler): eventually replace this function with the
@@ -174,8 +286,18 @@ func lineStart(f source.File, line int) token.Pos {
 	for {
 		offset := (min + max) / 2
 		pos := tok.Pos(offset)
-		posn := tok.Position(pos)
+		// Use the unadjusted position: line is always in terms of the
+		// on-disk file, and a //line directive elsewhere in the file
+		// must not perturb this binary search.
+		posn := tok.PositionFor(pos, false)
 		if posn.Line == line {
+			if adjusted := tok.PositionFor(pos, true); adjusted.Line != posn.Line || adjusted.Filename != posn.Filename {
+				if traceEnabled(false) {
+					const msg = "line-directive remap applied"
+					event.Log(ctx, msg, event.Label("on-disk", posn), event.Label("directive", adjusted))
+					notifyTrace(ctx, msg)
+				}
+			}
 			return pos - (token.Pos(posn.Column) - 1)
 		}
 
@@ -0,0 +1,78 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsp
+
+import (
+	"context"
+	"go/token"
+	"testing"
+
+	"golang.org/x/tools/internal/lsp/protocol"
+)
+
+// TestToProtocolPositionIgnoresLineDirective verifies that toProtocolPosition
+// reports positions in terms of the on-disk file the editor has open, even
+// when a //line directive (simulated here via (*token.File).AddLineInfo, the
+// same mechanism the compiler uses to record them) remaps everything after
+// it onto a different file and line -- as happens with generated code, cgo,
+// or goyacc/stringer output.
+func TestToProtocolPositionIgnoresLineDirective(t *testing.T) {
+	const content = "line one\nline two\nline three\n"
+	fset := token.NewFileSet()
+	tok := fset.AddFile("on-disk.go", -1, len(content))
+	for i, b := range []byte(content) {
+		if b == '\n' {
+			tok.AddLine(i + 1)
+		}
+	}
+	// Simulate a //line other.go:100 directive at the start of line two,
+	// remapping everything from there on into a different authored file.
+	line2Start := tok.LineStart(2)
+	tok.AddLineInfo(tok.Offset(line2Start), "other.go", 100)
+
+	got := toProtocolPosition(context.Background(), tok, []byte(content), UTF16PositionEncoding, line2Start)
+	want := protocol.Position{Line: 1, Character: 0}
+	if got != want {
+		t.Errorf("toProtocolPosition with //line directive = %+v, want %+v (on-disk line, not the directive-declared one)", got, want)
+	}
+}
+
+// TestColumnOffsetUTF16 checks that columnOffset treats pos.Character as a
+// count of UTF-16 code units, per the LSP spec, for lines containing BMP
+// characters (accented Latin, CJK) and non-BMP characters (emoji, which are
+// encoded as a UTF-16 surrogate pair and so count as 2 columns). utf16Column
+// must invert columnOffset exactly, since toProtocolPosition depends on it
+// to report the column back to the client.
+func TestColumnOffsetUTF16(t *testing.T) {
+	tests := []struct {
+		line string
+		char int // pos.Character, i.e. a UTF-16 code-unit count
+		want int // the corresponding byte offset into line
+	}{
+		{"café", 0, 0},
+		{"café", 1, 1},
+		{"café", 2, 2},
+		{"café", 3, 3},
+		{"café", 4, 5}, // end of line: é is 2 bytes but 1 UTF-16 unit
+		{"日本語", 0, 0},
+		{"日本語", 1, 3},
+		{"日本語", 2, 6},
+		{"日本語", 3, 9},
+		{"a😀b", 0, 0},
+		{"a😀b", 1, 1},
+		{"a😀b", 3, 5}, // 😀 is a surrogate pair: char 2 would land inside it
+		{"a😀b", 4, 6},
+	}
+	for _, test := range tests {
+		content := []byte(test.line + "\n")
+		got := columnOffset(content, protocol.Position{Line: 0, Character: float64(test.char)})
+		if got != test.want {
+			t.Errorf("columnOffset(%q, char=%d) = %d, want %d", test.line, test.char, got, test.want)
+		}
+		if back := utf16Column([]byte(test.line), got); back != test.char {
+			t.Errorf("utf16Column(%q, byteOffset=%d) = %d, want %d", test.line, got, back, test.char)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// URI represents the full URI for a file, such as
+// "file:///c:/Users/foo/bar.go" or "file:///home/foo/bar.go". It is kept in
+// URI form (rather than as a filesystem path) so that it round-trips
+// losslessly through the LSP, which exchanges URIs, not paths.
+type URI string
+
+// String returns the URI as a string.
+func (uri URI) String() string {
+	return string(uri)
+}
+
+// Filename returns the file path for uri. It panics if uri is not a valid
+// file URI, which should not happen for a URI obtained from ToURI or from
+// the LSP client, both of which only ever produce well-formed file URIs.
+func (uri URI) Filename() string {
+	filename, err := filename(uri)
+	if err != nil {
+		panic(err)
+	}
+	return filename
+}
+
+func filename(uri URI) (string, error) {
+	u, err := url.Parse(string(uri))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" {
+		return "", fmt.Errorf("only file URIs are supported, got %q from %q", u.Scheme, uri)
+	}
+	path := u.Path
+	if isWindowsDriveURIPath(path) {
+		path = path[1:]
+	}
+	if u.Host != "" {
+		// UNC path, e.g. file://server/share/foo.go -> //server/share/foo.go.
+		path = "//" + u.Host + path
+	}
+	return path, nil
+}
+
+// ToURI returns the file URI for path, which may use either '/' or '\' as
+// its separator and may be a drive-letter (c:\...) or UNC (\\server\share\...)
+// path.
+func ToURI(path string) URI {
+	path = strings.ReplaceAll(path, `\`, "/")
+	if isUNCPath(path) {
+		rest := strings.TrimPrefix(path, "//")
+		host, tail := rest, ""
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			host, tail = rest[:i], rest[i:]
+		}
+		return URI((&url.URL{Scheme: "file", Host: host, Path: tail}).String())
+	}
+	if isWindowsDrivePath(path) {
+		path = "/" + path
+	}
+	return URI((&url.URL{Scheme: "file", Path: path}).String())
+}
+
+// isWindowsDrivePath reports whether path begins with a drive letter, as in
+// "c:/Users/foo/bar.go".
+func isWindowsDrivePath(path string) bool {
+	if len(path) < 3 {
+		return false
+	}
+	return unicode.IsLetter(rune(path[0])) && path[1] == ':'
+}
+
+// isWindowsDriveURIPath reports whether path begins with a slash followed
+// by a drive letter, as in the URI path "/c:/Users/foo/bar.go".
+func isWindowsDriveURIPath(path string) bool {
+	if len(path) < 4 || path[0] != '/' {
+		return false
+	}
+	return unicode.IsLetter(rune(path[1])) && path[2] == ':'
+}
+
+// isUNCPath reports whether path is a UNC path, as in "//server/share/...".
+func isUNCPath(path string) bool {
+	return strings.HasPrefix(path, "//") && !strings.HasPrefix(path, "///")
+}
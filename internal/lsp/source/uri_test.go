@@ -0,0 +1,71 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package source
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestToURI(t *testing.T) {
+	tests := []struct {
+		path string
+		uri  URI
+	}{
+		{`/home/user/foo.go`, `file:///home/user/foo.go`},
+		{`c:/Users/foo/bar.go`, `file:///c:/Users/foo/bar.go`},
+		{`C:\Users\foo\bar.go`, `file:///C:/Users/foo/bar.go`},
+		{`//server/share/foo.go`, `file://server/share/foo.go`},
+		{`\\server\share\foo.go`, `file://server/share/foo.go`},
+		{`/home/user/a dir/foo#1.go`, `file:///home/user/a%20dir/foo%231.go`},
+	}
+	for _, test := range tests {
+		got := ToURI(test.path)
+		if got != test.uri {
+			t.Errorf("ToURI(%q) = %q, want %q", test.path, got, test.uri)
+		}
+	}
+}
+
+func TestURIFilename(t *testing.T) {
+	tests := []struct {
+		uri      URI
+		filename string
+	}{
+		{`file:///home/user/foo.go`, `/home/user/foo.go`},
+		{`file:///c:/Users/foo/bar.go`, `c:/Users/foo/bar.go`},
+		{`file://server/share/foo.go`, `//server/share/foo.go`},
+		{`file:///home/user/a%20dir/foo%231.go`, `/home/user/a dir/foo#1.go`},
+	}
+	for _, test := range tests {
+		if got := test.uri.Filename(); got != test.filename {
+			t.Errorf("%q.Filename() = %q, want %q", test.uri, got, test.filename)
+		}
+	}
+}
+
+// TestURISymlink checks that ToURI and Filename treat a symlinked path like
+// any other: the LSP client sends whatever path it has open, symlink or
+// not, and the URI conversion must round-trip that path unchanged rather
+// than silently resolving it to the symlink's target.
+func TestURISymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating a symlink on Windows requires elevated privileges")
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "real.go")
+	if err := os.WriteFile(target, []byte("package p\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.go")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	if got := ToURI(link).Filename(); got != link {
+		t.Errorf("ToURI(%q).Filename() = %q, want %q (must preserve the symlink path, not resolve it)", link, got, link)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package lsp
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+
+	"golang.org/x/tools/internal/lsp/protocol"
+)
+
+// TraceValue is the verbosity of server-side tracing, as defined by the LSP
+// spec's $/setTrace notification and "trace" initialize option: "off" (the
+// default -- no events are produced), "messages", or "verbose".
+type TraceValue string
+
+const (
+	TraceOff      TraceValue = "off"
+	TraceMessages TraceValue = "messages"
+	TraceVerbose  TraceValue = "verbose"
+)
+
+// traceState holds the server-wide trace configuration. There is exactly
+// one LSP server per process, so it is a package-level instance rather than
+// a *trace threaded through every conversion helper.
+var traceState struct {
+	mu      sync.Mutex
+	level   TraceValue
+	client  protocol.Client
+	logFile io.WriteCloser
+}
+
+func init() {
+	traceState.level = TraceOff
+}
+
+// SetTrace sets the server-wide trace verbosity. The server calls this from
+// its $/setTrace notification handler and from the "trace" initialize
+// option.
+func SetTrace(level TraceValue) {
+	traceState.mu.Lock()
+	defer traceState.mu.Unlock()
+	traceState.level = level
+}
+
+// SetTraceClient records the client to notify via window/logMessage and
+// $/logTrace once tracing is enabled. The server calls this once, after the
+// client connection for a session is established.
+func SetTraceClient(client protocol.Client) {
+	traceState.mu.Lock()
+	defer traceState.mu.Unlock()
+	traceState.client = client
+}
+
+// SetLogFile directs trace output to path, one JSON object per line, in
+// addition to any client notifications, rotating it lumberjack-style so a
+// long-running "verbose" session doesn't grow the file unbounded. The
+// server calls this from the "logFile" initialize option.
+func SetLogFile(path string) error {
+	logFile := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    100, // megabytes
+		MaxBackups: 7,
+		MaxAge:     30, // days
+		Compress:   true,
+	}
+	traceState.mu.Lock()
+	defer traceState.mu.Unlock()
+	if traceState.logFile != nil {
+		traceState.logFile.Close()
+	}
+	traceState.logFile = logFile
+	return nil
+}
+
+// traceEnabled reports whether a conversion event should be produced at
+// all, given the server's current trace level. verbose events (the
+// high-frequency per-position and per-column ones) additionally require
+// the "verbose" level; the rest only require tracing to be on.
+func traceEnabled(verbose bool) bool {
+	traceState.mu.Lock()
+	level := traceState.level
+	traceState.mu.Unlock()
+
+	if level == TraceOff {
+		return false
+	}
+	return !verbose || level == TraceVerbose
+}
+
+// notifyTrace reports message to the connected client, via both
+// window/logMessage and $/logTrace as the LSP spec's trace option
+// describes, and appends it to the configured log file, if any. It
+// replaces the old debugmsg helper, which unconditionally wrote to a
+// hard-coded Windows path and panicked if that path didn't already exist.
+func notifyTrace(ctx context.Context, message string) {
+	traceState.mu.Lock()
+	client, logFile := traceState.client, traceState.logFile
+	traceState.mu.Unlock()
+
+	if client != nil {
+		client.LogMessage(ctx, &protocol.LogMessageParams{
+			Type:    protocol.Log,
+			Message: message,
+		})
+		client.LogTrace(ctx, &protocol.LogTraceParams{Message: message})
+	}
+	if logFile != nil {
+		entry := struct {
+			Message string `json:"message"`
+		}{message}
+		if line, err := json.Marshal(entry); err == nil {
+			logFile.Write(append(line, '\n'))
+		}
+	}
+}